@@ -0,0 +1,191 @@
+package tar_diff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// ApplyReader reconstructs the new tar stream as an io.Reader instead of
+// pushing it into a supplied io.Writer like ApplyDelta, so the caller can
+// pull it into whatever it's piping to without buffering the whole result.
+type ApplyReader struct {
+	decoder      *zstd.Decoder
+	r            *bufio.Reader
+	extractedDir string
+	options      *Options
+
+	currentFile *currentFileReader
+	src         io.Reader // bytes remaining from the op currently being emitted
+	closed      bool
+}
+
+// NewApplyReader returns an io.ReadCloser that reconstructs the new tar
+// stream described by delta against the previously extracted contents of
+// extractedDir. Ops are consumed lazily on each Read; Close releases the
+// zstd decoder and any open current file. options is passed through to
+// openCurrentFileReader as in ApplyDelta, and may be nil.
+func NewApplyReader(delta io.Reader, extractedDir string, options *Options) (io.ReadCloser, error) {
+	buf := make([]byte, len(deltaHeader))
+	if _, err := io.ReadFull(delta, buf); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf, deltaHeader[:]) {
+		return nil, fmt.Errorf("Invalid delta format")
+	}
+
+	decoder, err := zstd.NewReader(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApplyReader{
+		decoder:      decoder,
+		r:            bufio.NewReader(decoder),
+		extractedDir: extractedDir,
+		options:      options,
+	}, nil
+}
+
+func (a *ApplyReader) Read(p []byte) (int, error) {
+	for {
+		for a.src == nil {
+			if err := a.nextOp(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := a.src.Read(p)
+		if err == io.EOF {
+			a.src = nil
+			err = nil
+			if n == 0 {
+				// A zero-length op (or a src that's already drained):
+				// loop around for the next one instead of recursing.
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// nextOp reads and applies the next delta op, leaving a.src set to the
+// reader for any output bytes it produced. Ops that don't produce output
+// (DeltaOpOpen, DeltaOpSeek) are applied in a loop by Read.
+func (a *ApplyReader) nextOp() error {
+	op, err := a.r.ReadByte()
+	if err != nil {
+		return err // io.EOF here means the delta is fully consumed
+	}
+
+	size, err := binary.ReadUvarint(a.r)
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case DeltaOpData:
+		a.src = io.LimitReader(a.r, int64(size))
+
+	case DeltaOpOpen:
+		nameBytes := make([]byte, size)
+		if _, err := io.ReadFull(a.r, nameBytes); err != nil {
+			return err
+		}
+		if a.currentFile != nil {
+			a.currentFile.Close()
+		}
+		a.currentFile, err = openCurrentFileReader(a.extractedDir+"/"+string(nameBytes), a.options)
+		if err != nil {
+			return err
+		}
+
+	case DeltaOpCopy:
+		if a.currentFile == nil {
+			return fmt.Errorf("No current file to copy from")
+		}
+		a.src = io.LimitReader(a.currentFile, int64(size))
+
+	case DeltaOpAddData:
+		if a.currentFile == nil {
+			return fmt.Errorf("No current file to copy from")
+		}
+		a.src = newAddDataReader(a.r, a.currentFile, size)
+
+	case DeltaOpSeek:
+		if a.currentFile == nil {
+			return fmt.Errorf("No current file to seek in")
+		}
+		if _, err := a.currentFile.Seek(int64(size), 0); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("Unexpected delta op %d", op)
+	}
+
+	return nil
+}
+
+// Close releases the zstd decoder and any file opened to satisfy a
+// DeltaOpCopy or DeltaOpAddData op.
+func (a *ApplyReader) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+
+	if a.currentFile != nil {
+		a.currentFile.Close()
+	}
+	a.decoder.Close()
+	return nil
+}
+
+// addDataReader adds bytes from currentFile byte-wise to data read from from,
+// windowed to whatever buffer the caller hands Read instead of allocating
+// size bytes up front.
+type addDataReader struct {
+	from        io.Reader
+	currentFile io.Reader
+	remaining   int64
+	buf2        []byte
+}
+
+func newAddDataReader(from, currentFile io.Reader, size uint64) *addDataReader {
+	return &addDataReader{from: from, currentFile: currentFile, remaining: int64(size)}
+}
+
+func (a *addDataReader) Read(p []byte) (int, error) {
+	if a.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > a.remaining {
+		p = p[:a.remaining]
+	}
+
+	n, err := a.from.Read(p)
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	if cap(a.buf2) < n {
+		a.buf2 = make([]byte, n)
+	}
+	buf2 := a.buf2[:n]
+	if _, err := io.ReadFull(a.currentFile, buf2); err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		p[i] += buf2[i]
+	}
+	a.remaining -= int64(n)
+	return n, nil
+}
@@ -0,0 +1,98 @@
+package tar_diff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// buildTestDelta writes a small delta by hand (open + add-data + literal
+// data ops against a single extracted file) so ApplyReader/ApplyDelta can
+// be exercised without a Diff implementation.
+func buildTestDelta(t *testing.T, oldContent []byte, addDiff []byte, literal []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := newDeltaWriter(&buf, 1)
+	if err != nil {
+		t.Fatalf("newDeltaWriter: %v", err)
+	}
+
+	if err := w.SetCurrentFile("a.txt"); err != nil {
+		t.Fatalf("SetCurrentFile: %v", err)
+	}
+	if err := w.Seek(0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if err := w.WriteAddContent(addDiff); err != nil {
+		t.Fatalf("WriteAddContent: %v", err)
+	}
+	if err := w.WriteContent(literal); err != nil {
+		t.Fatalf("WriteContent: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestNewApplyReaderRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	oldContent := []byte("hello")
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), oldContent, 0644); err != nil {
+		t.Fatalf("write extracted file: %v", err)
+	}
+
+	addDiff := []byte{1, 1, 1, 1, 1} // added to "hello" -> "ifmmp"
+	literal := []byte(" world")
+	delta := buildTestDelta(t, oldContent, addDiff, literal)
+
+	r, err := NewApplyReader(bytes.NewReader(delta), dir, nil)
+	if err != nil {
+		t.Fatalf("NewApplyReader: %v", err)
+	}
+	defer r.Close()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	want := "ifmmp world"
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewApplyReaderMatchesApplyDelta(t *testing.T) {
+	dir := t.TempDir()
+	oldContent := []byte("abcdefgh")
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), oldContent, 0644); err != nil {
+		t.Fatalf("write extracted file: %v", err)
+	}
+
+	addDiff := []byte{1, 1, 1, 1, 1, 1, 1, 1}
+	literal := []byte("!")
+	delta := buildTestDelta(t, oldContent, addDiff, literal)
+
+	r, err := NewApplyReader(bytes.NewReader(delta), dir, nil)
+	if err != nil {
+		t.Fatalf("NewApplyReader: %v", err)
+	}
+	viaReader, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	var viaWriter bytes.Buffer
+	if err := ApplyDelta(bytes.NewReader(delta), dir, &viaWriter, nil); err != nil {
+		t.Fatalf("ApplyDelta: %v", err)
+	}
+
+	if !bytes.Equal(viaReader, viaWriter.Bytes()) {
+		t.Fatalf("ApplyReader produced %q, ApplyDelta produced %q", viaReader, viaWriter.Bytes())
+	}
+}
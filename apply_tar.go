@@ -0,0 +1,150 @@
+package tar_diff
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// tarIndexEntry records where a regular file's content lives within a tar
+// archive's payload.
+type tarIndexEntry struct {
+	offset int64
+	size   int64
+}
+
+// buildTarIndex scans oldTar once, recording the payload offset and size of
+// every regular file it contains.
+func buildTarIndex(oldTar io.ReaderAt, oldSize int64) (map[string]tarIndexEntry, error) {
+	sr := io.NewSectionReader(oldTar, 0, oldSize)
+	cr := &countingReader{r: sr}
+	tr := tar.NewReader(cr)
+
+	index := make(map[string]tarIndexEntry)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		index[hdr.Name] = tarIndexEntry{offset: cr.n, size: hdr.Size}
+	}
+	return index, nil
+}
+
+// countingReader tracks how many bytes have been read through it, which
+// lets buildTarIndex recover the payload offset of each tar entry without
+// archive/tar exposing one directly.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ApplyDeltaToTar applies delta against oldTar directly instead of a
+// previously extracted directory, using an io.SectionReader over each
+// entry's payload as the "current file". Unlike ApplyDelta, it takes no
+// Options and does no decompression: a tar entry's section is used as-is,
+// so compressed per-file content is read as its compressed bytes.
+func ApplyDeltaToTar(delta io.Reader, oldTar io.ReaderAt, oldSize int64, dst io.Writer) error {
+	index, err := buildTarIndex(oldTar, oldSize)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(deltaHeader))
+	if _, err := io.ReadFull(delta, buf); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, deltaHeader[:]) {
+		return fmt.Errorf("Invalid delta format")
+	}
+
+	decoder, err := zstd.NewReader(delta)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	r := bufio.NewReader(decoder)
+
+	var currentFile *io.SectionReader
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case DeltaOpData:
+			if err := streamCopy(dst, r, size); err != nil {
+				return err
+			}
+
+		case DeltaOpOpen:
+			nameBytes := make([]byte, size)
+			if _, err := io.ReadFull(r, nameBytes); err != nil {
+				return err
+			}
+			name := string(nameBytes)
+			entry, ok := index[name]
+			if !ok {
+				return fmt.Errorf("%s not found in old tar", name)
+			}
+			currentFile = io.NewSectionReader(oldTar, entry.offset, entry.size)
+
+		case DeltaOpCopy:
+			if currentFile == nil {
+				return fmt.Errorf("No current file to copy from")
+			}
+			if err := streamCopy(dst, currentFile, size); err != nil {
+				return err
+			}
+
+		case DeltaOpAddData:
+			if currentFile == nil {
+				return fmt.Errorf("No current file to copy from")
+			}
+
+			if err := streamAddData(dst, r, currentFile, size); err != nil {
+				return err
+			}
+
+		case DeltaOpSeek:
+			if currentFile == nil {
+				return fmt.Errorf("No current file to seek in")
+			}
+			if _, err := currentFile.Seek(int64(size), 0); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("Unexpected delta op %d", op)
+		}
+	}
+
+	return nil
+}
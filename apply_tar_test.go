@@ -0,0 +1,64 @@
+package tar_diff
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+func buildTestTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name: name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%s): %v", name, err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("Write(%s): %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestApplyDeltaToTar(t *testing.T) {
+	oldTar := buildTestTar(t, map[string]string{
+		"a.txt": "hello world",
+		"b.txt": "unchanged",
+	})
+
+	var deltaBuf bytes.Buffer
+	w, err := newDeltaWriter(&deltaBuf, 1)
+	if err != nil {
+		t.Fatalf("newDeltaWriter: %v", err)
+	}
+	if err := w.WriteOldFile("a.txt", uint64(len("hello world"))); err != nil {
+		t.Fatalf("WriteOldFile: %v", err)
+	}
+	if err := w.WriteOldFile("b.txt", uint64(len("unchanged"))); err != nil {
+		t.Fatalf("WriteOldFile: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var out bytes.Buffer
+	oldReaderAt := bytes.NewReader(oldTar)
+	if err := ApplyDeltaToTar(bytes.NewReader(deltaBuf.Bytes()), oldReaderAt, int64(len(oldTar)), &out); err != nil {
+		t.Fatalf("ApplyDeltaToTar: %v", err)
+	}
+
+	want := "hello worldunchanged"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}
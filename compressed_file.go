@@ -0,0 +1,119 @@
+package tar_diff
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// currentFileReader is the "current file" used by ApplyDelta while
+// replaying DeltaOpCopy/DeltaOpAddData/DeltaOpSeek ops. Extracted content
+// is normally plain, but options.InputCompression (or autodetection) lets
+// it be one of the supported compressed formats instead, in which case
+// Seek can't address the underlying file directly: it restarts
+// decompression from the start of the file when seeking backwards, then
+// discards up to the target position.
+type currentFileReader struct {
+	file        *os.File
+	compression Compression
+	reader      io.ReadCloser
+	pos         int64
+}
+
+// openCurrentFileReader opens path and, if its contents are compressed
+// (per options.InputCompression, or autodetected when that's
+// CompressionAutodetect), wraps it so Read yields the decompressed bytes.
+func openCurrentFileReader(path string, options *Options) (*currentFileReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	compression := CompressionAutodetect
+	if options != nil {
+		compression = options.InputCompression()
+	}
+
+	var src io.Reader = f
+	if compression == CompressionAutodetect {
+		detected, br, err := DetectCompression(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		compression = detected
+		if detected == CompressionNone {
+			// Peeking to detect may have pulled bytes from f past offset
+			// 0 into br's buffer; rewind so plain content is read (and
+			// later seeked) directly off f instead of through that buffer.
+			if _, err := f.Seek(0, 0); err != nil {
+				f.Close()
+				return nil, err
+			}
+		} else {
+			src = br
+		}
+	}
+
+	dr, err := decompressor(compression, src)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &currentFileReader{file: f, compression: compression, reader: dr}, nil
+}
+
+func (c *currentFileReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *currentFileReader) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.reader.Close()
+	return c.file.Close()
+}
+
+// Seek only supports io.SeekStart (whence 0), which is all ApplyDelta ever
+// asks for: DeltaOpSeek always carries an absolute position. Uncompressed
+// content seeks the underlying file directly; compressed content isn't
+// byte-addressable, so reaching pos means discarding decompressed bytes up
+// to it, after first rewinding to the start of the decompressed stream if
+// pos is behind the current position.
+func (c *currentFileReader) Seek(pos int64, whence int) (int64, error) {
+	if whence != 0 {
+		return 0, fmt.Errorf("Unsupported seek whence %d", whence)
+	}
+
+	if c.compression == CompressionNone {
+		n, err := c.file.Seek(pos, 0)
+		c.pos = n
+		return n, err
+	}
+
+	if pos < c.pos {
+		if _, err := c.file.Seek(0, 0); err != nil {
+			return 0, err
+		}
+		dr, err := decompressor(c.compression, c.file)
+		if err != nil {
+			return 0, err
+		}
+		c.reader.Close()
+		c.reader = dr
+		c.pos = 0
+	}
+
+	if pos > c.pos {
+		if _, err := io.CopyN(ioutil.Discard, c.reader, pos-c.pos); err != nil {
+			return 0, err
+		}
+		c.pos = pos
+	}
+	return c.pos, nil
+}
@@ -0,0 +1,102 @@
+package tar_diff
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+)
+
+// Compression identifies the compression format of a tar input stream.
+type Compression int
+
+const (
+	// CompressionAutodetect asks ApplyDelta (and the other appliers that
+	// take Options) to sniff the extracted content's leading bytes rather
+	// than assume a fixed format. This is the default.
+	CompressionAutodetect Compression = iota
+	CompressionNone
+	CompressionGzip
+	CompressionBzip2
+	CompressionXz
+	CompressionZstd
+)
+
+var (
+	gzipMagic  = []byte{0x1F, 0x8B, 0x08}
+	bzip2Magic = []byte{0x42, 0x5A, 0x68}
+	xzMagic    = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}
+	zstdMagic  = []byte{0x28, 0xB5, 0x2F, 0xFD}
+)
+
+// DetectCompression peeks at the first few bytes of r, without consuming
+// them, and returns which of the supported compression formats it matches.
+// The returned reader must be used in place of r for any subsequent
+// reading, since it may have buffered bytes read during detection.
+func DetectCompression(r io.Reader) (Compression, *bufio.Reader, error) {
+	br := bufio.NewReaderSize(r, 4096)
+
+	head, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return CompressionNone, br, err
+	}
+
+	switch {
+	case hasPrefix(head, gzipMagic):
+		return CompressionGzip, br, nil
+	case hasPrefix(head, bzip2Magic):
+		return CompressionBzip2, br, nil
+	case hasPrefix(head, xzMagic):
+		return CompressionXz, br, nil
+	case hasPrefix(head, zstdMagic):
+		return CompressionZstd, br, nil
+	default:
+		return CompressionNone, br, nil
+	}
+}
+
+func hasPrefix(data, prefix []byte) bool {
+	if len(data) < len(prefix) {
+		return false
+	}
+	for i, b := range prefix {
+		if data[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// decompressor returns a reader that yields the uncompressed bytes of r,
+// which is assumed to be encoded with compression. For CompressionNone and
+// CompressionAutodetect (the latter should normally be resolved via
+// DetectCompression first) it returns r unchanged, wrapped so the result is
+// always an io.ReadCloser.
+func decompressor(compression Compression, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone, CompressionAutodetect:
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case CompressionXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("Unknown compression %d", compression)
+	}
+}
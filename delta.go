@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"github.com/klauspost/compress/zstd"
 	"io"
-	"os"
 )
 
 const (
@@ -46,17 +45,24 @@ func newDeltaWriter(writer io.Writer, compressionLevel int) (*deltaWriter, error
 }
 
 func (d *deltaWriter) writeOp(op uint8, size uint64, data []byte) error {
+	return writeDeltaOp(d.writer, op, size, data)
+}
+
+// writeDeltaOp encodes a single delta op (op byte, uvarint size, optional
+// data) to w. Shared by deltaWriter and IndexedWriter, which differ
+// only in where the encoded ops end up.
+func writeDeltaOp(w io.Writer, op uint8, size uint64, data []byte) error {
 	buf := make([]byte, 1+binary.MaxVarintLen64)
 	buf[0] = op
 	sizeLen := binary.PutUvarint(buf[1:], size)
 	bufLen := 1 + sizeLen
 
-	if _, err := d.writer.Write(buf[:bufLen]); err != nil {
+	if _, err := w.Write(buf[:bufLen]); err != nil {
 		return err
 	}
 
 	if data != nil {
-		if _, err := d.writer.Write(data); err != nil {
+		if _, err := w.Write(data); err != nil {
 			return err
 		}
 	}
@@ -77,6 +83,9 @@ func (d *deltaWriter) Close() error {
 	if d.writer == nil {
 		return nil
 	}
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
 	err := d.writer.Close()
 	d.writer = nil
 	return err
@@ -158,18 +167,26 @@ func (d *deltaWriter) CopyFile(size uint64) error {
 	return nil
 }
 
+// WriteAddContent emits data as one or more DeltaOpAddData ops, capping
+// each at LargeObjectThreshold so a single large per-file diff doesn't have
+// to be held as one op by ApplyDelta.
 func (d *deltaWriter) WriteAddContent(data []byte) error {
-	err := d.FlushBuffer()
-	if err != nil {
+	if err := d.FlushBuffer(); err != nil {
 		return err
 	}
 
-	size := uint64(len(data))
-	err = d.writeOp(DeltaOpAddData, size, data)
-	if err != nil {
-		return err
+	for len(data) > 0 {
+		chunk := data
+		if uint64(len(chunk)) > LargeObjectThreshold {
+			chunk = chunk[:LargeObjectThreshold]
+		}
+
+		if err := d.writeOp(DeltaOpAddData, uint64(len(chunk)), chunk); err != nil {
+			return err
+		}
+		d.currentPos += uint64(len(chunk))
+		data = data[len(chunk):]
 	}
-	d.currentPos += size
 	return nil
 }
 
@@ -208,7 +225,9 @@ func maybeClose(closer io.Closer) {
 	closer.Close()
 }
 
-func ApplyDelta(delta io.Reader, extractedDir string, dst io.Writer) error {
+func ApplyDelta(delta io.Reader, extractedDir string, dst io.Writer, options *Options) error {
+	delta = withProgress(delta, "apply", options)
+
 	buf := make([]byte, len(deltaHeader))
 	_, err := io.ReadFull(delta, buf)
 	if err != nil {
@@ -226,7 +245,7 @@ func ApplyDelta(delta io.Reader, extractedDir string, dst io.Writer) error {
 
 	r := bufio.NewReader(decoder)
 
-	var currentFile *os.File
+	var currentFile *currentFileReader
 	defer maybeClose(currentFile)
 
 	for {
@@ -245,8 +264,7 @@ func ApplyDelta(delta io.Reader, extractedDir string, dst io.Writer) error {
 
 		switch op {
 		case DeltaOpData:
-			_, err = io.CopyN(dst, r, int64(size))
-			if err != nil {
+			if err := streamCopy(dst, r, size); err != nil {
 				return err
 			}
 		case DeltaOpOpen:
@@ -260,7 +278,7 @@ func ApplyDelta(delta io.Reader, extractedDir string, dst io.Writer) error {
 			if currentFile != nil {
 				currentFile.Close()
 			}
-			currentFile, err = os.Open(path)
+			currentFile, err = openCurrentFileReader(path, options)
 			if err != nil {
 				return err
 			}
@@ -269,8 +287,7 @@ func ApplyDelta(delta io.Reader, extractedDir string, dst io.Writer) error {
 				return fmt.Errorf("No current file to copy from")
 			}
 
-			_, err = io.CopyN(dst, currentFile, int64(size))
-			if err != nil {
+			if err := streamCopy(dst, currentFile, size); err != nil {
 				return err
 			}
 		case DeltaOpAddData:
@@ -278,22 +295,7 @@ func ApplyDelta(delta io.Reader, extractedDir string, dst io.Writer) error {
 				return fmt.Errorf("No current file to copy from")
 			}
 
-			addBytes := make([]byte, size)
-			_, err = io.ReadFull(r, addBytes)
-			if err != nil {
-				return err
-			}
-
-			addBytes2 := make([]byte, size)
-			_, err = io.ReadFull(currentFile, addBytes2)
-			if err != nil {
-				return err
-			}
-
-			for i := uint64(0); i < size; i++ {
-				addBytes[i] = addBytes[i] + addBytes2[i]
-			}
-			if _, err := dst.Write(addBytes); err != nil {
+			if err := streamAddData(dst, r, currentFile, size); err != nil {
 				return err
 			}
 
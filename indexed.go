@@ -0,0 +1,477 @@
+package tar_diff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// indexedFrameSize is the target amount of uncompressed op data gathered
+// into a single zstd frame before it's flushed to the delta output, at a
+// file boundary.
+const indexedFrameSize = 4 * 1024 * 1024
+
+// maxIndexedFrameSize hard-caps how large frameBuf can grow before it's
+// force-flushed, even in the middle of one file's ops. Without this, a
+// single multi-hundred-MB file (the exact case LargeObjectThreshold
+// streaming exists to handle) would make indexed mode buffer the whole
+// file in memory before ever compressing and releasing it, undoing that
+// guarantee for exactly the inputs it matters most for. When a file's ops
+// cross this boundary, it gets a second, continuation TOC entry whose ops
+// reopen the file and reposition to where the first entry's ops left off.
+const maxIndexedFrameSize = 16 * 1024 * 1024
+
+// indexedTrailerSize is the fixed size, in bytes, of the trailer appended
+// to an indexed delta: 8 bytes magic, 8 bytes TOC offset, 8 bytes TOC size,
+// 8 bytes reserved.
+const indexedTrailerSize = 32
+
+var indexedMagic = [8]byte{'t', 'd', 'i', 'x', '1', '\n', 0, 0}
+
+// indexedTocEntry records where a single output tar entry's ops ended up:
+// which frame, and where within that frame's decompressed bytes they
+// start.
+type indexedTocEntry struct {
+	Name                  string `json:"name"`
+	DeltaOffsetInFrame    int64  `json:"deltaOffsetInFrame"`
+	FrameOffset           int64  `json:"frameOffset"`
+	FrameCompressedSize   int64  `json:"frameCompressedSize"`
+	FrameUncompressedSize int64  `json:"frameUncompressedSize"`
+}
+
+type indexedToc struct {
+	Entries []indexedTocEntry `json:"entries"`
+}
+
+// IndexedWriter produces the framed, random-access delta format: ops are
+// gathered into ~indexedFrameSize chunks, each compressed as its own
+// independent zstd frame, with a single file's ops never split across two
+// frames (except past maxIndexedFrameSize). A JSON table of contents
+// listing where each file's ops landed is appended after the last frame,
+// followed by a fixed-size trailer pointing at it, so OpenIndexed can find
+// it without scanning the whole delta.
+type IndexedWriter struct {
+	dst     io.Writer
+	encoder *zstd.Encoder
+	written int64
+
+	frameBuf       bytes.Buffer
+	pendingEntries []*indexedTocEntry
+	entries        []indexedTocEntry
+
+	buffer      []byte
+	currentFile string
+	currentPos  uint64
+}
+
+// NewIndexedWriter returns an IndexedWriter for callers that want to
+// produce an indexed delta directly (there's no Diff in this package yet
+// to pick the format via an Options flag). Its write methods mirror
+// deltaWriter's.
+func NewIndexedWriter(dst io.Writer, compressionLevel int) (*IndexedWriter, error) {
+	if _, err := dst.Write(deltaHeader[:]); err != nil {
+		return nil, err
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &IndexedWriter{
+		dst:     dst,
+		encoder: encoder,
+		written: int64(len(deltaHeader)),
+		buffer:  make([]byte, 0, deltaDataChunkSize),
+	}, nil
+}
+
+func (d *IndexedWriter) writeOp(op uint8, size uint64, data []byte) error {
+	return writeDeltaOp(&d.frameBuf, op, size, data)
+}
+
+func (d *IndexedWriter) FlushBuffer() error {
+	if len(d.buffer) == 0 {
+		return nil
+	}
+	err := d.writeOp(DeltaOpData, uint64(len(d.buffer)), d.buffer)
+	d.buffer = d.buffer[:0]
+	if err != nil {
+		return err
+	}
+	return d.splitFrameIfNeeded()
+}
+
+// splitFrameIfNeeded force-flushes frameBuf if it has grown past
+// maxIndexedFrameSize in the middle of the current file's ops, starting a
+// continuation TOC entry for the same file that reopens it and repositions
+// to currentPos before its ops resume.
+func (d *IndexedWriter) splitFrameIfNeeded() error {
+	if d.currentFile == "" || d.frameBuf.Len() < maxIndexedFrameSize {
+		return nil
+	}
+
+	name := d.currentFile
+	pos := d.currentPos
+
+	if err := d.flushFrame(); err != nil {
+		return err
+	}
+
+	entry := &indexedTocEntry{Name: name, DeltaOffsetInFrame: int64(d.frameBuf.Len())}
+	d.pendingEntries = append(d.pendingEntries, entry)
+
+	nameBytes := []byte(name)
+	if err := writeDeltaOp(&d.frameBuf, DeltaOpOpen, uint64(len(nameBytes)), nameBytes); err != nil {
+		return err
+	}
+	if pos != 0 {
+		if err := writeDeltaOp(&d.frameBuf, DeltaOpSeek, pos, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushFrame compresses whatever ops have been gathered in frameBuf as one
+// independent zstd frame, writes it out, and records the frame's location
+// and size on every entry whose ops it holds.
+func (d *IndexedWriter) flushFrame() error {
+	if d.frameBuf.Len() == 0 {
+		return nil
+	}
+
+	compressed := d.encoder.EncodeAll(d.frameBuf.Bytes(), nil)
+
+	frameOffset := d.written
+	if _, err := d.dst.Write(compressed); err != nil {
+		return err
+	}
+	d.written += int64(len(compressed))
+
+	for _, e := range d.pendingEntries {
+		e.FrameOffset = frameOffset
+		e.FrameCompressedSize = int64(len(compressed))
+		e.FrameUncompressedSize = int64(d.frameBuf.Len())
+		d.entries = append(d.entries, *e)
+	}
+
+	d.frameBuf.Reset()
+	d.pendingEntries = nil
+	return nil
+}
+
+// SetCurrentFile switches to a new file, starting a new frame first if the
+// current one has already grown past indexedFrameSize.
+func (d *IndexedWriter) SetCurrentFile(filename string) error {
+	if d.currentFile == filename {
+		return nil
+	}
+
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
+
+	if d.frameBuf.Len() >= indexedFrameSize {
+		if err := d.flushFrame(); err != nil {
+			return err
+		}
+	}
+
+	entry := &indexedTocEntry{Name: filename, DeltaOffsetInFrame: int64(d.frameBuf.Len())}
+	d.pendingEntries = append(d.pendingEntries, entry)
+
+	nameBytes := []byte(filename)
+	if err := d.writeOp(DeltaOpOpen, uint64(len(nameBytes)), nameBytes); err != nil {
+		return err
+	}
+
+	d.currentFile = filename
+	d.currentPos = 0
+	return nil
+}
+
+func (d *IndexedWriter) Seek(pos uint64) error {
+	if d.currentPos == pos {
+		return nil
+	}
+
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
+	if err := d.writeOp(DeltaOpSeek, pos, nil); err != nil {
+		return err
+	}
+	d.currentPos = pos
+	return nil
+}
+
+func (d *IndexedWriter) CopyFile(size uint64) error {
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
+	if err := d.writeOp(DeltaOpCopy, size, nil); err != nil {
+		return err
+	}
+	d.currentPos += size
+	return d.splitFrameIfNeeded()
+}
+
+func (d *IndexedWriter) CopyFileAt(offset uint64, size uint64) error {
+	if err := d.Seek(offset); err != nil {
+		return err
+	}
+	return d.CopyFile(size)
+}
+
+func (d *IndexedWriter) WriteOldFile(filename string, size uint64) error {
+	if err := d.SetCurrentFile(filename); err != nil {
+		return err
+	}
+	if err := d.Seek(0); err != nil {
+		return err
+	}
+	return d.CopyFile(size)
+}
+
+// WriteAddContent emits data as one or more DeltaOpAddData ops, capping
+// each at LargeObjectThreshold, matching deltaWriter.WriteAddContent.
+func (d *IndexedWriter) WriteAddContent(data []byte) error {
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		chunk := data
+		if uint64(len(chunk)) > LargeObjectThreshold {
+			chunk = chunk[:LargeObjectThreshold]
+		}
+		if err := d.writeOp(DeltaOpAddData, uint64(len(chunk)), chunk); err != nil {
+			return err
+		}
+		d.currentPos += uint64(len(chunk))
+		data = data[len(chunk):]
+
+		if err := d.splitFrameIfNeeded(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *IndexedWriter) WriteContent(data []byte) error {
+	d.buffer = append(d.buffer, data...)
+	if len(d.buffer) >= deltaDataChunkSize {
+		return d.FlushBuffer()
+	}
+	return nil
+}
+
+func (d *IndexedWriter) Write(data []byte) (int, error) {
+	err := d.WriteContent(data)
+	return len(data), err
+}
+
+// Close flushes the last frame, writes the JSON table of contents, and
+// appends the fixed trailer pointing at it.
+func (d *IndexedWriter) Close() error {
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
+	if err := d.flushFrame(); err != nil {
+		return err
+	}
+	d.encoder.Close()
+
+	tocBytes, err := json.Marshal(indexedToc{Entries: d.entries})
+	if err != nil {
+		return err
+	}
+
+	tocOffset := d.written
+	if _, err := d.dst.Write(tocBytes); err != nil {
+		return err
+	}
+	d.written += int64(len(tocBytes))
+
+	trailer := make([]byte, indexedTrailerSize)
+	copy(trailer[:8], indexedMagic[:])
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(tocOffset))
+	binary.BigEndian.PutUint64(trailer[16:24], uint64(len(tocBytes)))
+
+	_, err = d.dst.Write(trailer)
+	return err
+}
+
+// IndexedDelta provides random access to an indexed delta produced with
+// NewIndexedWriter: a caller only pays to decompress the frames covering
+// the entries it asks for via ApplyFile, instead of decoding the whole
+// delta start-to-finish.
+type IndexedDelta struct {
+	ra      io.ReaderAt
+	entries map[string][]indexedTocEntry
+	names   []string
+}
+
+// OpenIndexed reads the trailer and table of contents from the end of an
+// indexed delta.
+func OpenIndexed(delta io.ReaderAt, size int64) (*IndexedDelta, error) {
+	if size < indexedTrailerSize {
+		return nil, fmt.Errorf("Delta too small to be an indexed delta")
+	}
+
+	trailer := make([]byte, indexedTrailerSize)
+	if _, err := delta.ReadAt(trailer, size-indexedTrailerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[:8], indexedMagic[:]) {
+		return nil, fmt.Errorf("Not an indexed delta")
+	}
+
+	tocOffset := int64(binary.BigEndian.Uint64(trailer[8:16]))
+	tocSize := int64(binary.BigEndian.Uint64(trailer[16:24]))
+
+	tocBytes := make([]byte, tocSize)
+	if _, err := delta.ReadAt(tocBytes, tocOffset); err != nil {
+		return nil, err
+	}
+
+	var toc indexedToc
+	if err := json.Unmarshal(tocBytes, &toc); err != nil {
+		return nil, err
+	}
+
+	d := &IndexedDelta{
+		ra:      delta,
+		entries: make(map[string][]indexedTocEntry, len(toc.Entries)),
+	}
+	for _, e := range toc.Entries {
+		if _, seen := d.entries[e.Name]; !seen {
+			d.names = append(d.names, e.Name)
+		}
+		// A file whose ops crossed a maxIndexedFrameSize boundary gets more
+		// than one entry, in the order its ops were written.
+		d.entries[e.Name] = append(d.entries[e.Name], e)
+	}
+	return d, nil
+}
+
+// Files lists the tar entries this delta can reconstruct.
+func (d *IndexedDelta) Files() []string {
+	return d.names
+}
+
+// ApplyFile reconstructs just the single tar entry name, against the
+// previously extracted contents of extractedDir, decompressing only the
+// frame(s) that hold its ops. A file whose ops crossed a
+// maxIndexedFrameSize boundary during writing has more than one entry,
+// applied here in order. options is passed through to openCurrentFileReader
+// as in ApplyDelta, and may be nil.
+func (d *IndexedDelta) ApplyFile(name string, extractedDir string, dst io.Writer, options *Options) error {
+	entries, ok := d.entries[name]
+	if !ok {
+		return fmt.Errorf("%s not found in indexed delta", name)
+	}
+
+	for _, entry := range entries {
+		if err := d.applyEntry(entry, name, extractedDir, dst, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEntry replays the ops for a single TOC entry, which cover either
+// the whole of name or, for a file split across frames, one contiguous
+// chunk of it.
+func (d *IndexedDelta) applyEntry(entry indexedTocEntry, name string, extractedDir string, dst io.Writer, options *Options) error {
+	compressed := make([]byte, entry.FrameCompressedSize)
+	if _, err := d.ra.ReadAt(compressed, entry.FrameOffset); err != nil {
+		return err
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	frame, err := decoder.DecodeAll(compressed, nil)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(bytes.NewReader(frame[entry.DeltaOffsetInFrame:]))
+
+	var currentFile *currentFileReader
+	defer maybeClose(currentFile)
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case DeltaOpOpen:
+			nameBytes := make([]byte, size)
+			if _, err := io.ReadFull(r, nameBytes); err != nil {
+				return err
+			}
+			if string(nameBytes) != name {
+				// Ops for the next file sharing this frame: we're done.
+				return nil
+			}
+			currentFile, err = openCurrentFileReader(extractedDir+"/"+name, options)
+			if err != nil {
+				return err
+			}
+
+		case DeltaOpData:
+			if err := streamCopy(dst, r, size); err != nil {
+				return err
+			}
+
+		case DeltaOpCopy:
+			if currentFile == nil {
+				return fmt.Errorf("No current file to copy from")
+			}
+			if err := streamCopy(dst, currentFile, size); err != nil {
+				return err
+			}
+
+		case DeltaOpAddData:
+			if currentFile == nil {
+				return fmt.Errorf("No current file to copy from")
+			}
+			if err := streamAddData(dst, r, currentFile, size); err != nil {
+				return err
+			}
+
+		case DeltaOpSeek:
+			if currentFile == nil {
+				return fmt.Errorf("No current file to seek in")
+			}
+			if _, err := currentFile.Seek(int64(size), 0); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("Unexpected delta op %d", op)
+		}
+	}
+
+	return nil
+}
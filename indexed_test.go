@@ -0,0 +1,174 @@
+package tar_diff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexedDeltaRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("write extracted file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("world"), 0644); err != nil {
+		t.Fatalf("write extracted file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewIndexedWriter(&buf, 1)
+	if err != nil {
+		t.Fatalf("NewIndexedWriter: %v", err)
+	}
+	if err := w.WriteOldFile("a.txt", 5); err != nil {
+		t.Fatalf("WriteOldFile(a.txt): %v", err)
+	}
+	if err := w.WriteOldFile("b.txt", 5); err != nil {
+		t.Fatalf("WriteOldFile(b.txt): %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	delta := buf.Bytes()
+	idx, err := OpenIndexed(bytes.NewReader(delta), int64(len(delta)))
+	if err != nil {
+		t.Fatalf("OpenIndexed: %v", err)
+	}
+
+	files := idx.Files()
+	if len(files) != 2 {
+		t.Fatalf("Files() = %v, want 2 entries", files)
+	}
+
+	for name, want := range map[string]string{"a.txt": "hello", "b.txt": "world"} {
+		var out bytes.Buffer
+		if err := idx.ApplyFile(name, dir, &out, nil); err != nil {
+			t.Fatalf("ApplyFile(%s): %v", name, err)
+		}
+		if out.String() != want {
+			t.Fatalf("ApplyFile(%s) = %q, want %q", name, out.String(), want)
+		}
+	}
+}
+
+// TestIndexedDeltaSeekBeforeOpen reproduces the sequence CopyFileAt(offset,
+// size) emits for the first access of a file when offset != 0: a
+// DeltaOpSeek immediately after DeltaOpOpen, before any DeltaOpCopy. The
+// file must already be open by then.
+func TestIndexedDeltaSeekBeforeOpen(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello world"), 0644); err != nil {
+		t.Fatalf("write extracted file: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewIndexedWriter(&buf, 1)
+	if err != nil {
+		t.Fatalf("NewIndexedWriter: %v", err)
+	}
+	if err := w.SetCurrentFile("a.txt"); err != nil {
+		t.Fatalf("SetCurrentFile: %v", err)
+	}
+	if err := w.CopyFileAt(6, 5); err != nil {
+		t.Fatalf("CopyFileAt: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	delta := buf.Bytes()
+	idx, err := OpenIndexed(bytes.NewReader(delta), int64(len(delta)))
+	if err != nil {
+		t.Fatalf("OpenIndexed: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := idx.ApplyFile("a.txt", dir, &out, nil); err != nil {
+		t.Fatalf("ApplyFile: %v", err)
+	}
+	if out.String() != "world" {
+		t.Fatalf("got %q, want %q", out.String(), "world")
+	}
+}
+
+// TestIndexedDeltaLargeFileSplitsAcrossFrames writes a single file whose
+// add-content ops cross maxIndexedFrameSize, exercising
+// splitFrameIfNeeded's continuation-TOC-entry path end to end.
+func TestIndexedDeltaLargeFileSplitsAcrossFrames(t *testing.T) {
+	dir := t.TempDir()
+	size := maxIndexedFrameSize + 3*1024*1024
+
+	oldContent := make([]byte, size)
+	for i := range oldContent {
+		oldContent[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "big.bin"), oldContent, 0644); err != nil {
+		t.Fatalf("write extracted file: %v", err)
+	}
+
+	addDiff := make([]byte, size)
+	for i := range addDiff {
+		addDiff[i] = 1
+	}
+
+	var buf bytes.Buffer
+	w, err := NewIndexedWriter(&buf, 1)
+	if err != nil {
+		t.Fatalf("NewIndexedWriter: %v", err)
+	}
+	if err := w.SetCurrentFile("big.bin"); err != nil {
+		t.Fatalf("SetCurrentFile: %v", err)
+	}
+	if err := w.WriteAddContent(addDiff); err != nil {
+		t.Fatalf("WriteAddContent: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	delta := buf.Bytes()
+	idx, err := OpenIndexed(bytes.NewReader(delta), int64(len(delta)))
+	if err != nil {
+		t.Fatalf("OpenIndexed: %v", err)
+	}
+
+	if got := len(idx.entries["big.bin"]); got < 2 {
+		t.Fatalf("got %d TOC entries for big.bin, want at least 2 (ops should have crossed maxIndexedFrameSize)", got)
+	}
+
+	var out bytes.Buffer
+	if err := idx.ApplyFile("big.bin", dir, &out, nil); err != nil {
+		t.Fatalf("ApplyFile: %v", err)
+	}
+
+	want := make([]byte, size)
+	for i := range want {
+		want[i] = oldContent[i] + 1
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("round-tripped content mismatch (%d bytes)", len(out.Bytes()))
+	}
+}
+
+func TestIndexedDeltaApplyFileUnknownName(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewIndexedWriter(&buf, 1)
+	if err != nil {
+		t.Fatalf("NewIndexedWriter: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	delta := buf.Bytes()
+	idx, err := OpenIndexed(bytes.NewReader(delta), int64(len(delta)))
+	if err != nil {
+		t.Fatalf("OpenIndexed: %v", err)
+	}
+
+	if err := idx.ApplyFile("missing.txt", ".", &bytes.Buffer{}, nil); err == nil {
+		t.Fatalf("expected an error for an unknown file")
+	}
+}
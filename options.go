@@ -0,0 +1,47 @@
+package tar_diff
+
+// Options controls the behavior of ApplyDelta and its variants. This
+// package has no Diff yet, so compressionLevel only matters to callers
+// producing their own deltas via deltaWriter/IndexedWriter directly.
+type Options struct {
+	compressionLevel int
+	inputCompression Compression
+	onProgress       ProgressFunc
+}
+
+// NewOptions returns an Options with the default zstd compression level and
+// autodetection of extracted-content compression.
+func NewOptions() *Options {
+	return &Options{
+		compressionLevel: 3,
+		inputCompression: CompressionAutodetect,
+	}
+}
+
+// SetCompressionLevel sets the zstd compression level used for the delta
+// stream itself.
+func (o *Options) SetCompressionLevel(level int) {
+	o.compressionLevel = level
+}
+
+func (o *Options) CompressionLevel() int {
+	return o.compressionLevel
+}
+
+// SetInputCompression overrides autodetection of the compression of the
+// extracted content ApplyDelta reconstructs against. Pass
+// CompressionAutodetect (the default) to sniff it from the content instead.
+func (o *Options) SetInputCompression(compression Compression) {
+	o.inputCompression = compression
+}
+
+func (o *Options) InputCompression() Compression {
+	return o.inputCompression
+}
+
+// SetOnProgress registers a callback invoked as ApplyDelta consumes its
+// input, letting callers drive a progress bar or status line for
+// longer-running operations.
+func (o *Options) SetOnProgress(onProgress ProgressFunc) {
+	o.onProgress = onProgress
+}
@@ -0,0 +1,54 @@
+package tar_diff
+
+import (
+	"io"
+	"os"
+)
+
+// ProgressFunc is invoked as ApplyDelta consumes its input. stage
+// identifies which phase of the operation is progressing ("apply" is the
+// only one today; "scan-old"/"scan-new"/"emit-delta" are reserved for a
+// future Diff). bytesTotal is -1 when the total size of the underlying
+// input isn't known.
+type ProgressFunc func(stage string, bytesDone, bytesTotal int64)
+
+// progressReader wraps an io.Reader, reporting bytes read under stage to
+// onProgress as they're consumed.
+type progressReader struct {
+	r          io.Reader
+	stage      string
+	total      int64
+	done       int64
+	onProgress ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	p.onProgress(p.stage, p.done, p.total)
+	return n, err
+}
+
+// withProgress wraps r so reads are reported under stage to the callback
+// set with options.SetOnProgress. If options is nil or has no callback, r
+// is returned unchanged.
+func withProgress(r io.Reader, stage string, options *Options) io.Reader {
+	if options == nil || options.onProgress == nil {
+		return r
+	}
+	return &progressReader{r: r, stage: stage, total: sizeOf(r), onProgress: options.onProgress}
+}
+
+// sizeOf returns r's size via os.Stat when r is a *os.File, or -1 if the
+// total size isn't known.
+func sizeOf(r io.Reader) int64 {
+	f, ok := r.(*os.File)
+	if !ok {
+		return -1
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
@@ -0,0 +1,98 @@
+package tar_diff
+
+import (
+	"io"
+	"sync"
+)
+
+// LargeObjectThreshold is the op size, in bytes, above which a
+// DeltaOpAddData op is processed through fixed-size windows instead of a
+// single in-memory buffer, bounding peak memory regardless of how large the
+// op is. DeltaOpCopy and DeltaOpData ops are always streamed through a
+// pooled buffer, whatever their size.
+const LargeObjectThreshold = 1024 * 1024 // 1 MiB
+
+const streamBufferSize = 256 * 1024
+
+var streamBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, streamBufferSize)
+		return &b
+	},
+}
+
+func getStreamBuffer() []byte {
+	return *(streamBufferPool.Get().(*[]byte))
+}
+
+func putStreamBuffer(b []byte) {
+	streamBufferPool.Put(&b)
+}
+
+// streamCopy copies size bytes from src to dst using a pooled buffer,
+// avoiding the per-call allocation io.Copy would otherwise make.
+func streamCopy(dst io.Writer, src io.Reader, size uint64) error {
+	buf := getStreamBuffer()
+	defer putStreamBuffer(buf)
+
+	n, err := io.CopyBuffer(dst, io.LimitReader(src, int64(size)), buf)
+	if err == nil && n < int64(size) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// streamAddData reads size bytes from each of r and currentFile, adds them
+// byte-wise, and writes the result to dst. Below LargeObjectThreshold it
+// does this with two straight allocations, as before; above it, it walks
+// both inputs through fixed-size pooled windows so a single huge op can't
+// blow out peak memory.
+func streamAddData(dst io.Writer, r io.Reader, currentFile io.Reader, size uint64) error {
+	if size <= LargeObjectThreshold {
+		addBytes := make([]byte, size)
+		if _, err := io.ReadFull(r, addBytes); err != nil {
+			return err
+		}
+
+		addBytes2 := make([]byte, size)
+		if _, err := io.ReadFull(currentFile, addBytes2); err != nil {
+			return err
+		}
+
+		for i := range addBytes {
+			addBytes[i] += addBytes2[i]
+		}
+		_, err := dst.Write(addBytes)
+		return err
+	}
+
+	buf1 := getStreamBuffer()
+	defer putStreamBuffer(buf1)
+	buf2 := getStreamBuffer()
+	defer putStreamBuffer(buf2)
+
+	remaining := size
+	for remaining > 0 {
+		n := uint64(len(buf1))
+		if n > remaining {
+			n = remaining
+		}
+
+		if _, err := io.ReadFull(r, buf1[:n]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(currentFile, buf2[:n]); err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < n; i++ {
+			buf1[i] += buf2[i]
+		}
+		if _, err := dst.Write(buf1[:n]); err != nil {
+			return err
+		}
+
+		remaining -= n
+	}
+	return nil
+}